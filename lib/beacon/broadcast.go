@@ -7,13 +7,34 @@
 package beacon
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/thejerf/suture"
 )
 
+// readTimeout bounds how long a Serve loop blocks in a single ReadFrom,
+// so it periodically wakes up to notice that Stop has been called.
+const readTimeout = time.Second
+
+// defaultIfaceCacheTTL bounds how long the writer trusts a previously
+// computed set of broadcast destinations before re-scanning interfaces.
+const defaultIfaceCacheTTL = 10 * time.Second
+
+// defaultMaxPayloadCoalesce bounds how many pending payloads the writer
+// will fast-forward through, while waiting out MinInterval, in favor of
+// the most recent one.
+const defaultMaxPayloadCoalesce = 8
+
+// defaultDedupWindow is how long the reader remembers a (source, payload)
+// pair in order to suppress duplicate deliveries of the same
+// announcement arriving over several interfaces.
+const defaultDedupWindow = 5 * time.Second
+
 type Broadcast struct {
 	*suture.Supervisor
 	port   int
@@ -21,9 +42,92 @@ type Broadcast struct {
 	outbox chan recv
 	br     *broadcastReader
 	bw     *broadcastWriter
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// Option customizes the behavior of a beacon created with NewBroadcast,
+// NewBroadcastContext, or NewMulticast. Not every option applies to every
+// transport; see each Option's doc comment.
+type Option func(*options)
+
+type options struct {
+	minInterval   time.Duration
+	maxCoalesce   int
+	ifaceCacheTTL time.Duration
+	signer        func([]byte) []byte
+	verifier      func([]byte) ([]byte, bool)
+	dedupWindow   time.Duration
+}
+
+// WithMinInterval sets the minimum time that must pass between two
+// outgoing sends. Send calls arriving before the interval has elapsed are
+// coalesced; see WithMaxPayloadCoalesce. The default is zero, i.e. no
+// throttling.
+func WithMinInterval(d time.Duration) Option {
+	return func(o *options) { o.minInterval = d }
+}
+
+// WithMaxPayloadCoalesce bounds how many queued payloads the writer will
+// skip ahead through, while waiting out MinInterval, in order to send
+// only the most recently queued one.
+func WithMaxPayloadCoalesce(n int) Option {
+	return func(o *options) { o.maxCoalesce = n }
+}
+
+// WithInterfaceCacheTTL sets how long the writer caches the computed set
+// of broadcast destinations before re-scanning net.InterfaceAddrs.
+func WithInterfaceCacheTTL(d time.Duration) Option {
+	return func(o *options) { o.ifaceCacheTTL = d }
 }
 
-func NewBroadcast(port int) *Broadcast {
+// WithSigner wraps every outgoing payload with sign before it is sent,
+// e.g. to add an HMAC or Ed25519 envelope that WithVerifier can check on
+// the receiving end.
+func WithSigner(sign func([]byte) []byte) Option {
+	return func(o *options) { o.signer = sign }
+}
+
+// WithVerifier unwraps and verifies incoming packets before they are
+// delivered on Recv. verify returns the inner payload and whether the
+// envelope was valid; packets that fail verification are dropped rather
+// than surfaced to Recv. With no verifier configured, incoming packets
+// are delivered as-is, which keeps Broadcast backward-compatible with
+// unsigned peers.
+func WithVerifier(verify func([]byte) ([]byte, bool)) Option {
+	return func(o *options) { o.verifier = verify }
+}
+
+// WithDedupWindow sets how long the reader remembers a (source, payload)
+// pair in order to suppress duplicate deliveries of the same
+// announcement arriving over several interfaces. Set to zero to disable
+// deduplication entirely. The default is 5 seconds.
+func WithDedupWindow(d time.Duration) Option {
+	return func(o *options) { o.dedupWindow = d }
+}
+
+// NewBroadcast returns a Broadcast bound to context.Background(), i.e.
+// one that only stops when Stop is called explicitly. See
+// NewBroadcastContext to tie its lifetime to a context instead.
+func NewBroadcast(port int, opts ...Option) *Broadcast {
+	return NewBroadcastContext(context.Background(), port, opts...)
+}
+
+// NewBroadcastContext returns a Broadcast whose socket lifetime is tied
+// to ctx: canceling ctx stops the beacon just as calling Stop would, and
+// Send/Recv return errStopped once it is done. The ctx passed to a single
+// Send or Recv call only bounds that call, which returns its ctx.Err().
+func NewBroadcastContext(ctx context.Context, port int, opts ...Option) *Broadcast {
+	o := options{
+		maxCoalesce:   defaultMaxPayloadCoalesce,
+		ifaceCacheTTL: defaultIfaceCacheTTL,
+		dedupWindow:   defaultDedupWindow,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	b := &Broadcast{
 		Supervisor: suture.New("broadcastBeacon", suture.Spec{
 			// Don't retry too frenetically: an error to open a socket or
@@ -41,29 +145,56 @@ func NewBroadcast(port int) *Broadcast {
 		port:   port,
 		inbox:  make(chan []byte),
 		outbox: make(chan recv, 16),
+		done:   make(chan struct{}),
 	}
 
 	b.br = &broadcastReader{
 		port:   port,
 		outbox: b.outbox,
+		opts:   o,
+		dedup:  newDedupe(o.dedupWindow),
+		stop:   make(chan struct{}),
 	}
 	b.Add(b.br)
 	b.bw = &broadcastWriter{
 		port:  port,
 		inbox: b.inbox,
+		opts:  o,
+		stop:  make(chan struct{}),
 	}
 	b.Add(b.bw)
 
+	go func() {
+		select {
+		case <-ctx.Done():
+			b.Stop()
+		case <-b.done:
+		}
+	}()
+
 	return b
 }
 
-func (b *Broadcast) Send(data []byte) {
-	b.inbox <- data
+func (b *Broadcast) Send(ctx context.Context, data []byte) error {
+	select {
+	case b.inbox <- data:
+		return nil
+	case <-b.done:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (b *Broadcast) Recv() ([]byte, net.Addr) {
-	recv := <-b.outbox
-	return recv.data, recv.src
+func (b *Broadcast) Recv(ctx context.Context) ([]byte, net.Addr, error) {
+	select {
+	case recv := <-b.outbox:
+		return recv.data, recv.src, nil
+	case <-b.done:
+		return nil, nil, errStopped
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
 }
 
 func (b *Broadcast) Error() error {
@@ -73,11 +204,41 @@ func (b *Broadcast) Error() error {
 	return b.bw.Error()
 }
 
+// Stop stops the beacon's reader and writer and unblocks any pending or
+// future Send/Recv calls with errStopped.
+func (b *Broadcast) Stop() {
+	b.Supervisor.Stop()
+	b.doneOnce.Do(func() { close(b.done) })
+}
+
+// Stats returns a snapshot of the beacon's counters, giving operators
+// visibility into how much traffic is flowing and how much of it is
+// being dropped or rejected.
+func (b *Broadcast) Stats() Stats {
+	return Stats{
+		Received:     atomic.LoadUint64(&b.br.received),
+		DroppedFull:  atomic.LoadUint64(&b.br.droppedFull),
+		DroppedDup:   atomic.LoadUint64(&b.br.droppedDup),
+		VerifyFailed: atomic.LoadUint64(&b.br.verifyFailed),
+		BytesIn:      atomic.LoadUint64(&b.br.bytesIn),
+		BytesOut:     atomic.LoadUint64(&b.bw.bytesOut),
+	}
+}
+
 type broadcastWriter struct {
 	port  int
 	inbox chan []byte
+	opts  options
 	conn  *net.UDPConn
 	errorHolder
+
+	cachedDsts []net.IP
+	cachedAt   time.Time
+
+	bytesOut uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 func (w *broadcastWriter) Serve() {
@@ -97,8 +258,26 @@ func (w *broadcastWriter) Serve() {
 	}
 	defer w.conn.Close()
 
-	for bs := range w.inbox {
-		addrs, err := net.InterfaceAddrs()
+	var lastSent time.Time
+	for {
+		var bs []byte
+		select {
+		case b, ok := <-w.inbox:
+			if !ok {
+				return
+			}
+			bs = b
+		case <-w.stop:
+			return
+		}
+
+		bs = w.coalesce(bs, lastSent)
+
+		if w.opts.signer != nil {
+			bs = w.opts.signer(bs)
+		}
+
+		dsts, err := w.destinations()
 		if err != nil {
 			if debug {
 				l.Debugln(err)
@@ -107,19 +286,6 @@ func (w *broadcastWriter) Serve() {
 			continue
 		}
 
-		var dsts []net.IP
-		for _, addr := range addrs {
-			if iaddr, ok := addr.(*net.IPNet); ok && len(iaddr.IP) >= 4 && iaddr.IP.IsGlobalUnicast() && iaddr.IP.To4() != nil {
-				baddr := bcast(iaddr)
-				dsts = append(dsts, baddr.IP)
-			}
-		}
-
-		if len(dsts) == 0 {
-			// Fall back to the general IPv4 broadcast address
-			dsts = append(dsts, net.IP{0xff, 0xff, 0xff, 0xff})
-		}
-
 		if debug {
 			l.Debugln("addresses:", dsts)
 		}
@@ -129,7 +295,7 @@ func (w *broadcastWriter) Serve() {
 			dst := &net.UDPAddr{IP: ip, Port: w.port}
 
 			w.conn.SetWriteDeadline(time.Now().Add(time.Second))
-			_, err := w.conn.WriteTo(bs, dst)
+			n, err := w.conn.WriteTo(bs, dst)
 			w.conn.SetWriteDeadline(time.Time{})
 
 			if err, ok := err.(net.Error); ok && err.Timeout() {
@@ -163,17 +329,97 @@ func (w *broadcastWriter) Serve() {
 				l.Debugf("sent %d bytes to %s", len(bs), dst)
 			}
 
+			atomic.AddUint64(&w.bytesOut, uint64(n))
 			success++
 		}
 
 		if success > 0 {
 			w.setError(nil)
 		}
+
+		lastSent = time.Now()
+	}
+}
+
+// coalesce waits out MinInterval since lastSent before returning, draining
+// up to MaxPayloadCoalesce further payloads that arrive on inbox in the
+// meantime and keeping only the most recently queued one. Once that many
+// have been drained it still waits out the remainder of MinInterval, it
+// just stops coalescing further payloads into the wait. It is a no-op
+// when MinInterval is unset.
+func (w *broadcastWriter) coalesce(bs []byte, lastSent time.Time) []byte {
+	if w.opts.minInterval <= 0 {
+		return bs
+	}
+
+	drained := 0
+	for {
+		wait := w.opts.minInterval - time.Since(lastSent)
+		if wait <= 0 {
+			return bs
+		}
+
+		if drained >= w.opts.maxCoalesce {
+			select {
+			case <-w.stop:
+				return bs
+			case <-time.After(wait):
+				return bs
+			}
+		}
+
+		select {
+		case next, ok := <-w.inbox:
+			if !ok {
+				return bs
+			}
+			bs = next
+			drained++
+		case <-w.stop:
+			return bs
+		case <-time.After(wait):
+			return bs
+		}
+	}
+}
+
+// destinations returns the set of broadcast destination addresses,
+// computed from the local interfaces and cached for InterfaceCacheTTL to
+// avoid a syscall on every send.
+func (w *broadcastWriter) destinations() ([]net.IP, error) {
+	if w.opts.ifaceCacheTTL > 0 && !w.cachedAt.IsZero() && time.Since(w.cachedAt) < w.opts.ifaceCacheTTL {
+		return w.cachedDsts, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var dsts []net.IP
+	for _, addr := range addrs {
+		if iaddr, ok := addr.(*net.IPNet); ok && len(iaddr.IP) >= 4 && iaddr.IP.IsGlobalUnicast() && iaddr.IP.To4() != nil {
+			baddr := bcast(iaddr)
+			dsts = append(dsts, baddr.IP)
+		}
+	}
+
+	if len(dsts) == 0 {
+		// Fall back to the general IPv4 broadcast address
+		dsts = append(dsts, net.IP{0xff, 0xff, 0xff, 0xff})
 	}
+
+	w.cachedDsts = dsts
+	w.cachedAt = time.Now()
+
+	return dsts, nil
 }
 
 func (w *broadcastWriter) Stop() {
-	w.conn.Close()
+	w.stopOnce.Do(func() { close(w.stop) })
+	if w.conn != nil {
+		w.conn.Close()
+	}
 }
 
 func (w *broadcastWriter) String() string {
@@ -183,8 +429,19 @@ func (w *broadcastWriter) String() string {
 type broadcastReader struct {
 	port   int
 	outbox chan recv
+	opts   options
 	conn   *net.UDPConn
+	dedup  *dedupe
 	errorHolder
+
+	received     uint64
+	droppedFull  uint64
+	droppedDup   uint64
+	verifyFailed uint64
+	bytesIn      uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 func (r *broadcastReader) Serve() {
@@ -206,8 +463,19 @@ func (r *broadcastReader) Serve() {
 
 	bs := make([]byte, 65536)
 	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		r.conn.SetReadDeadline(time.Now().Add(readTimeout))
 		n, addr, err := r.conn.ReadFrom(bs)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// Just our own read deadline; loop around to check r.stop.
+				continue
+			}
 			if debug {
 				l.Debugln(err)
 			}
@@ -221,11 +489,36 @@ func (r *broadcastReader) Serve() {
 			l.Debugf("recv %d bytes from %s", n, addr)
 		}
 
+		atomic.AddUint64(&r.received, 1)
+		atomic.AddUint64(&r.bytesIn, uint64(n))
+
 		c := make([]byte, n)
 		copy(c, bs)
+
+		if r.opts.verifier != nil {
+			inner, ok := r.opts.verifier(c)
+			if !ok {
+				atomic.AddUint64(&r.verifyFailed, 1)
+				if debug {
+					l.Debugln("dropping unverified message from", addr)
+				}
+				continue
+			}
+			c = inner
+		}
+
+		if r.dedup != nil && r.dedup.seenRecently(addr, c) {
+			atomic.AddUint64(&r.droppedDup, 1)
+			if debug {
+				l.Debugln("dropping duplicate message from", addr)
+			}
+			continue
+		}
+
 		select {
 		case r.outbox <- recv{c, addr}:
 		default:
+			atomic.AddUint64(&r.droppedFull, 1)
 			if debug {
 				l.Debugln("dropping message")
 			}
@@ -235,7 +528,10 @@ func (r *broadcastReader) Serve() {
 }
 
 func (r *broadcastReader) Stop() {
-	r.conn.Close()
+	r.stopOnce.Do(func() { close(r.stop) })
+	if r.conn != nil {
+		r.conn.Close()
+	}
 }
 
 func (r *broadcastReader) String() string {
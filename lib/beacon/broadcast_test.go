@@ -0,0 +1,62 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"testing"
+	"time"
+)
+
+// TestCoalesceKeepsLatest verifies that coalesce waits out MinInterval
+// and returns the most recently queued payload, not the first one.
+func TestCoalesceKeepsLatest(t *testing.T) {
+	w := &broadcastWriter{
+		inbox: make(chan []byte, 2),
+		opts: options{
+			minInterval: 30 * time.Millisecond,
+			maxCoalesce: defaultMaxPayloadCoalesce,
+		},
+		stop: make(chan struct{}),
+	}
+
+	w.inbox <- []byte("second")
+
+	start := time.Now()
+	got := w.coalesce([]byte("first"), start)
+	elapsed := time.Since(start)
+
+	if string(got) != "second" {
+		t.Fatalf("coalesce returned %q, want %q", got, "second")
+	}
+	if elapsed < w.opts.minInterval {
+		t.Fatalf("coalesce returned after %v, want at least %v", elapsed, w.opts.minInterval)
+	}
+}
+
+// TestCoalesceZeroStillRateLimits verifies that WithMaxPayloadCoalesce(0)
+// disables coalescing without disabling the MinInterval rate limit.
+func TestCoalesceZeroStillRateLimits(t *testing.T) {
+	w := &broadcastWriter{
+		inbox: make(chan []byte, 1),
+		opts: options{
+			minInterval: 30 * time.Millisecond,
+			maxCoalesce: 0,
+		},
+		stop: make(chan struct{}),
+	}
+
+	start := time.Now()
+	got := w.coalesce([]byte("first"), start)
+	elapsed := time.Since(start)
+
+	if string(got) != "first" {
+		t.Fatalf("coalesce returned %q, want %q", got, "first")
+	}
+	if elapsed < w.opts.minInterval {
+		t.Fatalf("coalesce returned after %v, want at least %v (MaxPayloadCoalesce=0 must not disable rate limiting)", elapsed, w.opts.minInterval)
+	}
+}
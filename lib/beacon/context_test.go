@@ -0,0 +1,81 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestBroadcastContextCancelUnblocksSendRecv verifies that canceling the
+// context passed to NewBroadcastContext stops the beacon and causes any
+// blocked (or future) Send/Recv call to return errStopped instead of
+// hanging forever.
+func TestBroadcastContextCancelUnblocksSendRecv(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	b := NewBroadcastContext(ctx, 0)
+
+	errc := make(chan error, 2)
+	go func() {
+		_, _, err := b.Recv(context.Background())
+		errc <- err
+	}()
+	go func() {
+		err := b.Send(context.Background(), []byte("hello"))
+		errc <- err
+	}()
+
+	// Give the goroutines a chance to actually block before we cancel.
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	timeout := time.After(time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errc:
+			if err != errStopped {
+				t.Fatalf("got error %v, want %v", err, errStopped)
+			}
+		case <-timeout:
+			t.Fatal("Send/Recv did not unblock after context cancellation")
+		}
+	}
+}
+
+// TestBroadcastSendRecvCtxErr verifies that Send/Recv respect a
+// per-call context independent of the beacon's own lifetime: canceling
+// the context passed to Send/Recv unblocks that call with ctx.Err(),
+// without stopping the beacon itself.
+func TestBroadcastSendRecvCtxErr(t *testing.T) {
+	b := NewBroadcast(0)
+	defer b.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := b.Recv(ctx)
+		errc <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Recv did not unblock after its context was canceled")
+	}
+
+	if err := b.Error(); err != nil {
+		t.Fatalf("beacon reported unexpected error after an unrelated context cancellation: %v", err)
+	}
+}
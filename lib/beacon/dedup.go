@@ -0,0 +1,108 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"net"
+	"sync"
+	"time"
+)
+
+// defaultDedupMaxEntries bounds how many distinct (source, payload) keys
+// the dedupe cache remembers at once, regardless of the window. Without
+// it, a flood of distinct payloads from an unverified source (see
+// WithVerifier) could grow the cache, and the per-packet eviction scan,
+// without bound for as long as the flood lasts.
+const defaultDedupMaxEntries = 1024
+
+// dedupe suppresses repeated deliveries of the same payload from the same
+// source seen within a sliding time window, e.g. an announcement that
+// reaches us once per local interface. It's a small LRU: entries age out
+// once they fall outside the window, but are also evicted oldest-first
+// once the cache holds more than maxEntries, bounding memory independent
+// of the window and the rate of incoming packets.
+type dedupe struct {
+	window     time.Duration
+	maxEntries int
+
+	mut     sync.Mutex
+	entries map[string]*list.Element
+	order   *list.List
+}
+
+type dedupeEntry struct {
+	key string
+	at  time.Time
+}
+
+// newDedupe returns a dedupe with the given window. A zero or negative
+// window disables deduplication: newDedupe then returns nil, and callers
+// skip the seenRecently check for a nil dedupe.
+func newDedupe(window time.Duration) *dedupe {
+	if window <= 0 {
+		return nil
+	}
+	return &dedupe{
+		window:     window,
+		maxEntries: defaultDedupMaxEntries,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// seenRecently reports whether an identical payload from addr was recorded
+// within the window, recording it as seen for next time if not. A
+// suppressed duplicate does not restart the window, so a payload repeated
+// more often than the window still gets through once per window.
+func (d *dedupe) seenRecently(addr net.Addr, payload []byte) bool {
+	key := dedupeKey(addr, payload)
+	now := time.Now()
+
+	d.mut.Lock()
+	defer d.mut.Unlock()
+
+	if el, ok := d.entries[key]; ok {
+		entry := el.Value.(*dedupeEntry)
+		d.order.MoveToFront(el)
+		if now.Sub(entry.at) < d.window {
+			return true
+		}
+		entry.at = now
+	} else {
+		d.entries[key] = d.order.PushFront(&dedupeEntry{key: key, at: now})
+	}
+
+	d.evict(now)
+
+	return false
+}
+
+// evict drops entries that have aged out of the window, then, if the
+// cache is still over maxEntries, the oldest remaining ones regardless of
+// age. It assumes mut is held.
+func (d *dedupe) evict(now time.Time) {
+	for d.order.Len() > 0 {
+		back := d.order.Back()
+		entry := back.Value.(*dedupeEntry)
+		if now.Sub(entry.at) < d.window && d.order.Len() <= d.maxEntries {
+			break
+		}
+		d.order.Remove(back)
+		delete(d.entries, entry.key)
+	}
+}
+
+func dedupeKey(addr net.Addr, payload []byte) string {
+	sum := sha256.Sum256(payload)
+	host := addr.String()
+	if a, _, err := net.SplitHostPort(host); err == nil {
+		host = a
+	}
+	return host + "/" + string(sum[:])
+}
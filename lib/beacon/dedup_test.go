@@ -0,0 +1,59 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	d := newDedupe(30 * time.Millisecond)
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 21027}
+
+	if d.seenRecently(addr, []byte("hello")) {
+		t.Fatal("first delivery reported as seen")
+	}
+	if !d.seenRecently(addr, []byte("hello")) {
+		t.Fatal("duplicate within window not suppressed")
+	}
+	if d.seenRecently(addr, []byte("goodbye")) {
+		t.Fatal("distinct payload reported as duplicate")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+
+	if d.seenRecently(addr, []byte("hello")) {
+		t.Fatal("delivery outside the window still suppressed")
+	}
+}
+
+func TestDedupeBoundedSize(t *testing.T) {
+	d := newDedupe(time.Minute)
+	d.maxEntries = 10
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 21027}
+
+	for i := 0; i < 100; i++ {
+		d.seenRecently(addr, []byte(fmt.Sprintf("payload-%d", i)))
+	}
+
+	d.mut.Lock()
+	n := d.order.Len()
+	d.mut.Unlock()
+
+	if n > d.maxEntries {
+		t.Fatalf("dedupe cache grew to %d entries, want at most %d", n, d.maxEntries)
+	}
+}
+
+func TestNewDedupeDisabled(t *testing.T) {
+	if d := newDedupe(0); d != nil {
+		t.Fatal("newDedupe(0) should return nil, disabling dedup")
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import "errors"
+
+// errStopped is returned by Send and Recv once the beacon has been
+// stopped, instead of blocking forever on a channel nobody will service
+// again.
+var errStopped = errors.New("beacon: stopped")
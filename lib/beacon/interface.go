@@ -0,0 +1,37 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"context"
+	"net"
+)
+
+// Interface is implemented by beacon transports, such as Broadcast and
+// Multicast, and by MultiBeacon which composes several of them. It lets
+// callers perform local discovery without caring which underlying
+// transport(s) are in play, and makes it possible to add further
+// transports (for example a relay-based one, tunneling announcements
+// through a remote server when LAN discovery is blocked) without
+// changing any calling code.
+//
+// Send and Recv are context-aware: they return ctx.Err() if ctx is done
+// before the operation completes, and errStopped once the beacon itself
+// has been stopped.
+type Interface interface {
+	Send(ctx context.Context, data []byte) error
+	Recv(ctx context.Context) ([]byte, net.Addr, error)
+	Error() error
+	Serve()
+	Stop()
+}
+
+var (
+	_ Interface = (*Broadcast)(nil)
+	_ Interface = (*Multicast)(nil)
+	_ Interface = (*MultiBeacon)(nil)
+)
@@ -0,0 +1,96 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// MultiBeacon fans Send out to, and merges Recv from, a set of child
+// Interfaces. It lets a caller do local discovery over several transports
+// at once (e.g. IPv4 broadcast and IPv6 multicast) as if it were a single
+// beacon.
+type MultiBeacon struct {
+	children []Interface
+	outbox   chan recv
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewMultiBeacon returns a MultiBeacon relaying Send to, and merging Recv
+// from, all of the given children.
+func NewMultiBeacon(children ...Interface) *MultiBeacon {
+	return &MultiBeacon{
+		children: children,
+		outbox:   make(chan recv, 16),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Send passes data to each child in turn. It returns the first error a
+// child returns, without sending to the children after it.
+func (m *MultiBeacon) Send(ctx context.Context, data []byte) error {
+	for _, c := range m.children {
+		if err := c.Send(ctx, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MultiBeacon) Recv(ctx context.Context) ([]byte, net.Addr, error) {
+	select {
+	case recv := <-m.outbox:
+		return recv.data, recv.src, nil
+	case <-m.stop:
+		return nil, nil, errStopped
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (m *MultiBeacon) Error() error {
+	for _, c := range m.children {
+		if err := c.Error(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Serve starts all children and relays their Recv into the merged outbox,
+// blocking until Stop is called.
+func (m *MultiBeacon) Serve() {
+	for _, c := range m.children {
+		go c.Serve()
+		go m.relay(c)
+	}
+	<-m.stop
+}
+
+func (m *MultiBeacon) relay(c Interface) {
+	for {
+		data, src, err := c.Recv(context.Background())
+		if err != nil {
+			return
+		}
+		select {
+		case m.outbox <- recv{data, src}:
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+func (m *MultiBeacon) Stop() {
+	m.stopOnce.Do(func() { close(m.stop) })
+	for _, c := range m.children {
+		c.Stop()
+	}
+}
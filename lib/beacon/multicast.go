@@ -0,0 +1,503 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thejerf/suture"
+	"golang.org/x/net/ipv6"
+)
+
+// ifaceRescanInterval governs how often we re-enumerate the local
+// interfaces looking for ones that have come up since we last joined the
+// multicast group. Interfaces that have gone away are not dropped from the
+// joined set, so one that comes back under the same index is not joined
+// again.
+const ifaceRescanInterval = 60 * time.Second
+
+type Multicast struct {
+	*suture.Supervisor
+	addr   *net.UDPAddr
+	inbox  chan []byte
+	outbox chan recv
+	mr     *multicastReader
+	mw     *multicastWriter
+
+	done     chan struct{}
+	doneOnce sync.Once
+}
+
+// NewMulticast returns a Multicast beacon that joins the given IPv6
+// multicast group (e.g. "[ff12::8384]:21027") on every suitable
+// multicast-capable interface. It accepts the same Options as
+// NewBroadcast, e.g. WithSigner/WithVerifier: Multicast has no
+// authentication of its own, so a caller merging it with a verified
+// Broadcast via NewMultiBeacon must configure the same verifier here too.
+func NewMulticast(addr string, opts ...Option) (*Multicast, error) {
+	gaddr, err := net.ResolveUDPAddr("udp6", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	o := options{
+		maxCoalesce:   defaultMaxPayloadCoalesce,
+		ifaceCacheTTL: defaultIfaceCacheTTL,
+		dedupWindow:   defaultDedupWindow,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	m := &Multicast{
+		Supervisor: suture.New("multicastBeacon", suture.Spec{
+			// Don't retry too frenetically: an error to open a socket or
+			// whatever is usually something that is either permanent or takes
+			// a while to get solved...
+			FailureThreshold: 2,
+			FailureBackoff:   60 * time.Second,
+			// Only log restarts in debug mode.
+			Log: func(line string) {
+				if debug {
+					l.Debugln(line)
+				}
+			},
+		}),
+		addr:   gaddr,
+		inbox:  make(chan []byte),
+		outbox: make(chan recv, 16),
+		done:   make(chan struct{}),
+	}
+
+	m.mr = &multicastReader{
+		addr:   gaddr,
+		outbox: m.outbox,
+		opts:   o,
+		dedup:  newDedupe(o.dedupWindow),
+		stop:   make(chan struct{}),
+	}
+	m.Add(m.mr)
+	m.mw = &multicastWriter{
+		addr:  gaddr,
+		inbox: m.inbox,
+		opts:  o,
+		stop:  make(chan struct{}),
+	}
+	m.Add(m.mw)
+
+	return m, nil
+}
+
+func (m *Multicast) Send(ctx context.Context, data []byte) error {
+	select {
+	case m.inbox <- data:
+		return nil
+	case <-m.done:
+		return errStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Multicast) Recv(ctx context.Context) ([]byte, net.Addr, error) {
+	select {
+	case recv := <-m.outbox:
+		return recv.data, recv.src, nil
+	case <-m.done:
+		return nil, nil, errStopped
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+}
+
+func (m *Multicast) Error() error {
+	if err := m.mr.Error(); err != nil {
+		return err
+	}
+	return m.mw.Error()
+}
+
+// Stop stops the beacon's reader and writer and unblocks any pending or
+// future Send/Recv calls with errStopped.
+func (m *Multicast) Stop() {
+	m.Supervisor.Stop()
+	m.doneOnce.Do(func() { close(m.done) })
+}
+
+// Stats returns a snapshot of the beacon's counters, giving operators
+// visibility into how much traffic is flowing and how much of it is
+// being dropped or rejected.
+func (m *Multicast) Stats() Stats {
+	return Stats{
+		Received:     atomic.LoadUint64(&m.mr.received),
+		DroppedFull:  atomic.LoadUint64(&m.mr.droppedFull),
+		DroppedDup:   atomic.LoadUint64(&m.mr.droppedDup),
+		VerifyFailed: atomic.LoadUint64(&m.mr.verifyFailed),
+		BytesIn:      atomic.LoadUint64(&m.mr.bytesIn),
+		BytesOut:     atomic.LoadUint64(&m.mw.bytesOut),
+	}
+}
+
+// multicastInterfaces returns the interfaces that are up and support
+// multicast, and are hence candidates for joining the beacon group on.
+func multicastInterfaces() []net.Interface {
+	var ifis []net.Interface
+
+	all, err := net.Interfaces()
+	if err != nil {
+		if debug {
+			l.Debugln(err)
+		}
+		return nil
+	}
+
+	for _, ifi := range all {
+		if ifi.Flags&net.FlagUp == 0 || ifi.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		ifis = append(ifis, ifi)
+	}
+
+	return ifis
+}
+
+type multicastWriter struct {
+	addr  *net.UDPAddr
+	inbox chan []byte
+	opts  options
+	conn  *ipv6.PacketConn
+	errorHolder
+
+	cachedIfis []net.Interface
+	cachedAt   time.Time
+
+	bytesOut uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (w *multicastWriter) Serve() {
+	if debug {
+		l.Debugln(w, "starting")
+		defer l.Debugln(w, "stopping")
+	}
+
+	// Bind an ephemeral port rather than w.addr.Port: that's the fixed
+	// port the reader listens on, and a second socket can't bind it too.
+	// We don't need a fixed source port to send.
+	pconn, err := net.ListenPacket("udp6", "[::]:0")
+	if err != nil {
+		if debug {
+			l.Debugln(err)
+		}
+		w.setError(err)
+		return
+	}
+	defer pconn.Close()
+
+	w.conn = ipv6.NewPacketConn(pconn)
+
+	var lastSent time.Time
+	for {
+		var bs []byte
+		select {
+		case b, ok := <-w.inbox:
+			if !ok {
+				return
+			}
+			bs = b
+		case <-w.stop:
+			return
+		}
+
+		bs = w.coalesce(bs, lastSent)
+
+		if w.opts.signer != nil {
+			bs = w.opts.signer(bs)
+		}
+
+		ifis := w.interfaces()
+		if len(ifis) == 0 && debug {
+			l.Debugln("no multicast capable interfaces")
+		}
+
+		success := 0
+		for _, ifi := range ifis {
+			if err := w.conn.SetMulticastInterface(&ifi); err != nil {
+				if debug {
+					l.Debugln(err)
+				}
+				continue
+			}
+
+			w.conn.SetWriteDeadline(time.Now().Add(time.Second))
+			_, err := w.conn.WriteTo(bs, nil, w.addr)
+			w.conn.SetWriteDeadline(time.Time{})
+
+			if err != nil {
+				if debug {
+					l.Debugln(err, "on", ifi.Name)
+				}
+				continue
+			}
+
+			if debug {
+				l.Debugf("sent %d bytes to %s on %s", len(bs), w.addr, ifi.Name)
+			}
+
+			atomic.AddUint64(&w.bytesOut, uint64(len(bs)))
+			success++
+		}
+
+		if success > 0 {
+			w.setError(nil)
+		} else {
+			w.setError(fmt.Errorf("no successful send to %s", w.addr))
+		}
+
+		lastSent = time.Now()
+	}
+}
+
+// coalesce waits out MinInterval since lastSent before returning, draining
+// up to MaxPayloadCoalesce further payloads that arrive on inbox in the
+// meantime and keeping only the most recently queued one. It is a no-op
+// when MinInterval is unset; see broadcastWriter.coalesce for the
+// equivalent behavior on the IPv4 broadcast transport.
+func (w *multicastWriter) coalesce(bs []byte, lastSent time.Time) []byte {
+	if w.opts.minInterval <= 0 {
+		return bs
+	}
+
+	drained := 0
+	for {
+		wait := w.opts.minInterval - time.Since(lastSent)
+		if wait <= 0 {
+			return bs
+		}
+
+		if drained >= w.opts.maxCoalesce {
+			select {
+			case <-w.stop:
+				return bs
+			case <-time.After(wait):
+				return bs
+			}
+		}
+
+		select {
+		case next, ok := <-w.inbox:
+			if !ok {
+				return bs
+			}
+			bs = next
+			drained++
+		case <-w.stop:
+			return bs
+		case <-time.After(wait):
+			return bs
+		}
+	}
+}
+
+// interfaces returns the multicast capable interfaces, cached for
+// InterfaceCacheTTL to avoid a net.Interfaces() syscall on every send.
+func (w *multicastWriter) interfaces() []net.Interface {
+	if w.opts.ifaceCacheTTL > 0 && !w.cachedAt.IsZero() && time.Since(w.cachedAt) < w.opts.ifaceCacheTTL {
+		return w.cachedIfis
+	}
+
+	ifis := multicastInterfaces()
+
+	w.cachedIfis = ifis
+	w.cachedAt = time.Now()
+
+	return ifis
+}
+
+func (w *multicastWriter) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+	if w.conn != nil {
+		w.conn.Close()
+	}
+}
+
+func (w *multicastWriter) String() string {
+	return fmt.Sprintf("multicastWriter@%p", w)
+}
+
+type multicastReader struct {
+	addr   *net.UDPAddr
+	outbox chan recv
+	opts   options
+	conn   *ipv6.PacketConn
+	dedup  *dedupe
+	errorHolder
+
+	received     uint64
+	droppedFull  uint64
+	droppedDup   uint64
+	verifyFailed uint64
+	bytesIn      uint64
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func (r *multicastReader) Serve() {
+	if debug {
+		l.Debugln(r, "starting")
+		defer l.Debugln(r, "stopping")
+	}
+
+	pconn, err := net.ListenPacket("udp6", fmt.Sprintf(":%d", r.addr.Port))
+	if err != nil {
+		if debug {
+			l.Debugln(err)
+		}
+		r.setError(err)
+		return
+	}
+	defer pconn.Close()
+
+	r.conn = ipv6.NewPacketConn(pconn)
+
+	joined := r.joinGroups(nil)
+	if len(joined) == 0 {
+		err := fmt.Errorf("unable to join %s on any interface", r.addr)
+		if debug {
+			l.Debugln(err)
+		}
+		r.setError(err)
+		return
+	}
+
+	rescan := time.NewTicker(ifaceRescanInterval)
+	defer rescan.Stop()
+	go func() {
+		for {
+			select {
+			case <-rescan.C:
+				joined = r.joinGroups(joined)
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+
+	bs := make([]byte, 65536)
+	for {
+		select {
+		case <-r.stop:
+			return
+		default:
+		}
+
+		r.conn.SetReadDeadline(time.Now().Add(readTimeout))
+		n, _, addr, err := r.conn.ReadFrom(bs)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				// Just our own read deadline; loop around to check r.stop.
+				continue
+			}
+			if debug {
+				l.Debugln(err)
+			}
+			r.setError(err)
+			return
+		}
+
+		r.setError(nil)
+
+		if debug {
+			l.Debugf("recv %d bytes from %s", n, addr)
+		}
+
+		atomic.AddUint64(&r.received, 1)
+		atomic.AddUint64(&r.bytesIn, uint64(n))
+
+		c := make([]byte, n)
+		copy(c, bs)
+
+		if r.opts.verifier != nil {
+			inner, ok := r.opts.verifier(c)
+			if !ok {
+				atomic.AddUint64(&r.verifyFailed, 1)
+				if debug {
+					l.Debugln("dropping unverified message from", addr)
+				}
+				continue
+			}
+			c = inner
+		}
+
+		if r.dedup != nil && r.dedup.seenRecently(addr, c) {
+			atomic.AddUint64(&r.droppedDup, 1)
+			if debug {
+				l.Debugln("dropping duplicate message from", addr)
+			}
+			continue
+		}
+
+		select {
+		case r.outbox <- recv{c, addr}:
+		default:
+			atomic.AddUint64(&r.droppedFull, 1)
+			if debug {
+				l.Debugln("dropping message")
+			}
+		}
+	}
+}
+
+// joinGroups joins the beacon multicast group on every multicast capable
+// interface that isn't already in already, returning the updated set.
+func (r *multicastReader) joinGroups(already []net.Interface) []net.Interface {
+	joined := already
+	for _, ifi := range multicastInterfaces() {
+		seen := false
+		for _, j := range joined {
+			if j.Index == ifi.Index {
+				seen = true
+				break
+			}
+		}
+		if seen {
+			continue
+		}
+
+		if err := r.conn.JoinGroup(&ifi, &net.UDPAddr{IP: r.addr.IP}); err != nil {
+			if debug {
+				l.Debugln(err, "on", ifi.Name)
+			}
+			continue
+		}
+
+		if debug {
+			l.Debugln("joined", r.addr, "on", ifi.Name)
+		}
+		joined = append(joined, ifi)
+	}
+	return joined
+}
+
+func (r *multicastReader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+	if r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+func (r *multicastReader) String() string {
+	return fmt.Sprintf("multicastReader@%p", r)
+}
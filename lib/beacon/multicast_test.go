@@ -0,0 +1,45 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestMulticastWriterDoesNotBindGroupPort verifies that multicastWriter
+// uses an ephemeral local port to send, rather than the fixed group port
+// the reader listens on. Binding both to the same port fails outright.
+func TestMulticastWriterDoesNotBindGroupPort(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp6", "[ff12::8384]:21027")
+	if err != nil {
+		t.Skip("IPv6 not available in this environment")
+	}
+
+	// Simulate the reader already holding the fixed beacon port.
+	held, err := net.ListenPacket("udp6", fmt.Sprintf(":%d", addr.Port))
+	if err != nil {
+		t.Skip("IPv6 not available in this environment")
+	}
+	defer held.Close()
+
+	w := &multicastWriter{
+		addr:  addr,
+		inbox: make(chan []byte),
+		stop:  make(chan struct{}),
+	}
+	go w.Serve()
+	defer w.Stop()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if err := w.Error(); err != nil {
+		t.Fatalf("writer failed to start while the group port was held: %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+// Stats is a snapshot of a Broadcast's traffic counters, as returned by
+// Broadcast.Stats.
+type Stats struct {
+	Received     uint64
+	DroppedFull  uint64
+	DroppedDup   uint64
+	VerifyFailed uint64
+	BytesIn      uint64
+	BytesOut     uint64
+}
@@ -0,0 +1,100 @@
+// Copyright (C) 2014 The Syncthing Authors.
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this file,
+// You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// sign/verify implement a trivial envelope (payload + fixed trailer) good
+// enough to exercise WithSigner/WithVerifier without pulling in real
+// crypto: the trailer stands in for an HMAC or signature.
+const verifyTrailer = "-signed"
+
+func sign(bs []byte) []byte {
+	return append(append([]byte{}, bs...), verifyTrailer...)
+}
+
+func verify(bs []byte) ([]byte, bool) {
+	if !bytes.HasSuffix(bs, []byte(verifyTrailer)) {
+		return nil, false
+	}
+	return bs[:len(bs)-len(verifyTrailer)], true
+}
+
+// TestVerifierUnwrapsSignedPayload verifies that a correctly signed
+// payload is accepted and unwrapped by the verifier configured on a
+// broadcastReader. It does not run broadcastReader.Serve or call Recv.
+func TestVerifierUnwrapsSignedPayload(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 21027}
+	r := &broadcastReader{
+		outbox: make(chan recv, 1),
+		opts:   options{verifier: verify},
+	}
+
+	c := sign([]byte("hello"))
+	inner, ok := r.opts.verifier(c)
+	if !ok {
+		t.Fatal("verifier rejected a correctly signed payload")
+	}
+	r.outbox <- recv{inner, addr}
+
+	got := <-r.outbox
+	if string(got.data) != "hello" {
+		t.Fatalf("got payload %q, want %q", got.data, "hello")
+	}
+}
+
+// TestVerifierRejectsUnsignedPayload verifies that the verifier rejects a
+// payload missing the expected envelope. The test itself replicates the
+// drop-and-count step of broadcastReader.Serve; Serve is not run.
+func TestVerifierRejectsUnsignedPayload(t *testing.T) {
+	r := &broadcastReader{
+		outbox: make(chan recv, 1),
+		opts:   options{verifier: verify},
+	}
+
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 21027}
+	c := []byte("not signed")
+
+	if inner, ok := r.opts.verifier(c); ok {
+		r.outbox <- recv{inner, addr}
+	} else {
+		r.verifyFailed++
+	}
+
+	select {
+	case <-r.outbox:
+		t.Fatal("unverified payload was delivered")
+	default:
+	}
+
+	if r.verifyFailed != 1 {
+		t.Fatalf("verifyFailed = %d, want 1", r.verifyFailed)
+	}
+}
+
+// TestNoVerifierIsBackwardCompatible checks that with neither WithSigner
+// nor WithVerifier configured, payloads pass through unchanged: existing
+// callers that never adopted the envelope keep working.
+func TestNoVerifierIsBackwardCompatible(t *testing.T) {
+	o := options{}
+
+	bs := []byte("hello")
+	if o.signer != nil {
+		bs = o.signer(bs)
+	}
+	if string(bs) != "hello" {
+		t.Fatalf("payload was altered with no signer configured: %q", bs)
+	}
+
+	if o.verifier != nil {
+		t.Fatal("verifier should be nil with neither option set")
+	}
+}